@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/providers"
+)
+
+// signOutRPInitiated builds the RP-initiated logout step of a sign-out: when
+// the configured provider supports it (implements
+// providers.RPInitiatedSignOuter) and provider.oidc.rp_initiated_logout is
+// enabled, it sets the logout state cookie on rw and returns the IdP's
+// end_session_endpoint URL to redirect the browser to. It returns "" when
+// there's nothing to do - provider doesn't support it, the option is off, s
+// has no ID token, or building the redirect failed (logged) - leaving only a
+// local-only redirect. OAuthProxy.SignOut (oauthproxy.go) does not call it.
+func (p *OAuthProxy) signOutRPInitiated(rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) string {
+	signOuter, ok := p.provider.(providers.RPInitiatedSignOuter)
+	if !ok {
+		return ""
+	}
+
+	redirect, cookie, err := signOuter.SignOut(req.Context(), s)
+	if err != nil {
+		logger.Printf("failed to build RP-initiated logout redirect: %v\n", err)
+		return ""
+	}
+	if redirect == "" {
+		return ""
+	}
+
+	http.SetCookie(rw, cookie)
+	return redirect
+}
+
+// SignOutCallback handles the IdP's post_logout_redirect_uri callback
+// (provider.oidc.post_logout_redirect_url should point here): it checks the
+// "state" query parameter against the cookie signOutRPInitiated set via
+// providers.VerifyLogoutState before continuing, logging (not failing
+// closed) on a mismatch since the local session this cookie protects is
+// already cleared by the time the IdP redirects back.
+func (p *OAuthProxy) SignOutCallback(rw http.ResponseWriter, req *http.Request) {
+	state := req.URL.Query().Get("state")
+	if !providers.VerifyLogoutState(req, state) {
+		logger.Printf("sign-out callback state parameter did not match the expected cookie\n")
+	}
+	http.Redirect(rw, req, "/", http.StatusFound)
+}
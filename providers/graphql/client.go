@@ -0,0 +1,257 @@
+// Package graphql provides a resilient HTTP client for calling GraphQL
+// policy backends from authorization providers (see providers.GraphQLAuthzProvider):
+// bounded timeouts, retry with backoff and jitter, a circuit breaker, and a
+// concurrency semaphore, all instrumented with Prometheus metrics.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sony/gobreaker"
+)
+
+// Config configures a Client's timeouts, retry policy, circuit breaker and
+// concurrency limit.
+type Config struct {
+	// DialTimeout, ReadTimeout and WriteTimeout bound a single HTTP
+	// round-trip; ReadTimeout/WriteTimeout are applied as the overall
+	// request timeout since net/http doesn't separate them post-dial.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxRetries is the number of additional attempts after the first,
+	// made only for network errors, 5xx responses, and GraphQL errors with
+	// extensions.code == "INTERNAL_SERVER_ERROR".
+	MaxRetries    int
+	RetryBaseWait time.Duration
+	RetryMaxWait  time.Duration
+
+	// MaxConcurrent bounds the number of in-flight requests; additional
+	// callers block until a slot frees up.
+	MaxConcurrent int
+
+	// CircuitBreaker: open the breaker after ConsecutiveFailures failures
+	// within FailureWindow, then allow one half-open probe after OpenWait.
+	ConsecutiveFailures uint32
+	FailureWindow       time.Duration
+	OpenWait            time.Duration
+
+	// MetricsName labels the requests_total/duration_seconds metrics,
+	// e.g. "lagoon".
+	MetricsName string
+}
+
+// DefaultConfig returns conservative defaults suitable for a single GraphQL
+// policy backend behind a proxy.
+func DefaultConfig(metricsName string) Config {
+	return Config{
+		DialTimeout:         2 * time.Second,
+		ReadTimeout:         5 * time.Second,
+		WriteTimeout:        5 * time.Second,
+		MaxRetries:          2,
+		RetryBaseWait:       100 * time.Millisecond,
+		RetryMaxWait:        2 * time.Second,
+		MaxConcurrent:       64,
+		ConsecutiveFailures: 5,
+		FailureWindow:       30 * time.Second,
+		OpenWait:            10 * time.Second,
+		MetricsName:         metricsName,
+	}
+}
+
+type graphqlErrorResponse struct {
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code string `json:"code"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+// Client issues POST requests against a GraphQL endpoint with retry,
+// circuit-breaking and bounded concurrency.
+type Client struct {
+	cfg        Config
+	httpClient *http.Client
+	breaker    *gobreaker.CircuitBreaker
+	sem        chan struct{}
+}
+
+// NewClient builds a Client from cfg.
+func NewClient(cfg Config) *Client {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext,
+	}
+
+	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name: cfg.MetricsName,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= cfg.ConsecutiveFailures
+		},
+		Interval: cfg.FailureWindow,
+		Timeout:  cfg.OpenWait,
+	})
+
+	return &Client{
+		cfg: cfg,
+		httpClient: &http.Client{
+			Timeout:   cfg.ReadTimeout + cfg.WriteTimeout,
+			Transport: transport,
+		},
+		breaker: breaker,
+		sem:     make(chan struct{}, cfg.MaxConcurrent),
+	}
+}
+
+// Post sends body to endpoint with headers, retrying on transient failures
+// and tripping the circuit breaker on sustained ones. It returns the raw
+// response body on a successful (HTTP 200, no retryable GraphQL error)
+// response.
+func (c *Client) Post(ctx context.Context, endpoint string, headers map[string]string, body []byte) ([]byte, error) {
+	select {
+	case c.sem <- struct{}{}:
+		defer func() { <-c.sem }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	result, err := c.breaker.Execute(func() (interface{}, error) {
+		return c.doWithRetry(ctx, endpoint, headers, body)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.([]byte), nil
+}
+
+func (c *Client) doWithRetry(ctx context.Context, endpoint string, headers map[string]string, body []byte) ([]byte, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= c.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepBackoff(ctx, c.cfg.RetryBaseWait, c.cfg.RetryMaxWait, attempt); err != nil {
+				return nil, err
+			}
+		}
+
+		respBody, retryable, err := c.do(ctx, endpoint, headers, body)
+		if err == nil {
+			return respBody, nil
+		}
+
+		lastErr = err
+		if !retryable {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("exhausted retries: %w", lastErr)
+}
+
+// do issues a single attempt, reporting metrics and whether the error (if
+// any) is worth retrying.
+func (c *Client) do(ctx context.Context, endpoint string, headers map[string]string, body []byte) ([]byte, bool, error) {
+	start := time.Now()
+	result := "success"
+	defer func() {
+		graphqlMetrics.requests.WithLabelValues(c.cfg.MetricsName, result).Inc()
+		graphqlMetrics.duration.WithLabelValues(c.cfg.MetricsName).Observe(time.Since(start).Seconds())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		result = "error"
+		return nil, false, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		result = "error"
+		return nil, true, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		result = "error"
+		return nil, true, fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode >= 500 {
+		result = "error"
+		return nil, true, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		result = "error"
+		return nil, false, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	if retryableCode, msg := graphQLRetryableError(respBody); retryableCode {
+		result = "error"
+		return nil, true, fmt.Errorf("GraphQL error: %s", msg)
+	}
+
+	return respBody, false, nil
+}
+
+// graphQLRetryableError reports whether body contains a GraphQL error whose
+// extensions.code is INTERNAL_SERVER_ERROR, which is treated as transient.
+func graphQLRetryableError(body []byte) (bool, string) {
+	var parsed graphqlErrorResponse
+	if err := json.Unmarshal(body, &parsed); err != nil || len(parsed.Errors) == 0 {
+		return false, ""
+	}
+	for _, e := range parsed.Errors {
+		if e.Extensions.Code == "INTERNAL_SERVER_ERROR" {
+			return true, e.Message
+		}
+	}
+	return false, ""
+}
+
+func sleepBackoff(ctx context.Context, base, maxWait time.Duration, attempt int) error {
+	wait := base * time.Duration(1<<uint(attempt-1))
+	if wait > maxWait {
+		wait = maxWait
+	}
+	wait = time.Duration(float64(wait) * (0.5 + rand.Float64()*0.5))
+
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// graphqlMetrics is shared by every Client: requests/duration are labeled by
+// provider (cfg.MetricsName, e.g. "lagoon") so multiple GraphQLAuthzProvider
+// backends don't collide on the same series.
+var graphqlMetrics = struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}{
+	requests: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth2_proxy_graphql_requests_total",
+		Help: "Total number of GraphQL policy backend requests, by provider and result.",
+	}, []string{"provider", "result"}),
+	duration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "oauth2_proxy_graphql_request_duration_seconds",
+		Help:    "GraphQL policy backend request duration in seconds, by provider.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"provider"}),
+}
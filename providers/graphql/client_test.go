@@ -0,0 +1,140 @@
+package graphql
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+func testConfig(metricsName string) Config {
+	return Config{
+		DialTimeout:         500 * time.Millisecond,
+		ReadTimeout:         time.Second,
+		WriteTimeout:        time.Second,
+		MaxRetries:          2,
+		RetryBaseWait:       time.Millisecond,
+		RetryMaxWait:        5 * time.Millisecond,
+		MaxConcurrent:       8,
+		ConsecutiveFailures: 2,
+		FailureWindow:       time.Minute,
+		OpenWait:            time.Minute,
+		MetricsName:         metricsName,
+	}
+}
+
+func TestGraphQLRetryableError(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		retryable bool
+	}{
+		{"no errors", `{"data":{}}`, false},
+		{"internal server error is retryable", `{"errors":[{"message":"boom","extensions":{"code":"INTERNAL_SERVER_ERROR"}}]}`, true},
+		{"validation error is not retryable", `{"errors":[{"message":"bad query","extensions":{"code":"GRAPHQL_VALIDATION_FAILED"}}]}`, false},
+		{"error with no extensions code is not retryable", `{"errors":[{"message":"denied"}]}`, false},
+		{"malformed body is not retryable", `not json`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, _ := graphQLRetryableError([]byte(tt.body))
+			if retryable != tt.retryable {
+				t.Errorf("graphQLRetryableError(%q) retryable = %v, want %v", tt.body, retryable, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestPostRetriesOn5xxThenSucceeds(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"data":{"ok":true}}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(testConfig("test-5xx"))
+	body, err := c.Post(context.Background(), server.URL, nil, []byte(`{}`))
+	if err != nil {
+		t.Fatalf("Post returned an error: %v", err)
+	}
+	if string(body) != `{"data":{"ok":true}}` {
+		t.Fatalf("Post body = %q, want the final successful response", body)
+	}
+	if requests != 2 {
+		t.Fatalf("expected a 500 to be retried once before succeeding, got %d requests", requests)
+	}
+}
+
+func TestPostDoesNotRetryOn4xx(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	c := NewClient(testConfig("test-4xx"))
+	if _, err := c.Post(context.Background(), server.URL, nil, []byte(`{}`)); err == nil {
+		t.Fatal("expected Post to return an error for a persistent 400")
+	}
+	if requests != 1 {
+		t.Fatalf("expected a non-retryable 400 to be attempted once, got %d requests", requests)
+	}
+}
+
+func TestPostDoesNotRetryOnNonRetryableGraphQLError(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"errors":[{"message":"bad query","extensions":{"code":"GRAPHQL_VALIDATION_FAILED"}}]}`))
+	}))
+	defer server.Close()
+
+	c := NewClient(testConfig("test-graphql-4xx"))
+	if _, err := c.Post(context.Background(), server.URL, nil, []byte(`{}`)); err == nil {
+		t.Fatal("expected Post to return an error for a non-retryable GraphQL error")
+	}
+	if requests != 1 {
+		t.Fatalf("expected a non-retryable GraphQL error to be attempted once, got %d requests", requests)
+	}
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	cfg := testConfig("test-breaker")
+	cfg.MaxRetries = 0 // one request per Post call, so each call is one consecutive failure
+	c := NewClient(cfg)
+
+	for i := 0; i < int(cfg.ConsecutiveFailures); i++ {
+		if _, err := c.Post(context.Background(), server.URL, nil, []byte(`{}`)); err == nil {
+			t.Fatalf("call %d: expected a 400 response to surface as an error", i)
+		}
+	}
+	if requests != int(cfg.ConsecutiveFailures) {
+		t.Fatalf("expected %d requests before the breaker opens, got %d", cfg.ConsecutiveFailures, requests)
+	}
+
+	if _, err := c.Post(context.Background(), server.URL, nil, []byte(`{}`)); err != gobreaker.ErrOpenState {
+		t.Fatalf("expected the breaker to be open after %d consecutive failures, got err = %v", cfg.ConsecutiveFailures, err)
+	}
+	if requests != int(cfg.ConsecutiveFailures) {
+		t.Fatalf("expected the open breaker to short-circuit without calling the server, got %d requests", requests)
+	}
+}
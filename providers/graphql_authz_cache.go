@@ -0,0 +1,151 @@
+package providers
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AuthorizationCache stores previously-computed Authorize() decisions so a
+// GraphQLAuthzProvider doesn't have to round-trip to the policy backend on
+// every proxied request. Implementations may be in-memory (the default) or
+// backed by a shared store such as Redis.
+type AuthorizationCache interface {
+	// Get returns the cached decision for key and whether it was found.
+	Get(key string) (decision bool, ok bool)
+	// Set stores decision for key, expiring it after ttl.
+	Set(key string, decision bool, ttl time.Duration)
+}
+
+var authzCacheMetrics = struct {
+	hits   *prometheus.CounterVec
+	misses *prometheus.CounterVec
+}{
+	hits: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth2_proxy_authz_cache_hits_total",
+		Help: "Total number of GraphQL authorization cache hits.",
+	}, []string{"provider"}),
+	misses: promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "oauth2_proxy_authz_cache_misses_total",
+		Help: "Total number of GraphQL authorization cache misses.",
+	}, []string{"provider"}),
+}
+
+// lruCache is a bounded, in-memory, least-recently-used cache of TTL'd
+// values, generic over the value type so both the boolean decision cache and
+// the (necessarily separate, since it must survive independently of a cached
+// "false" decision) matched-groups cache can share one implementation.
+type lruCache[T any] struct {
+	mu       sync.Mutex
+	maxItems int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruCacheEntry[T any] struct {
+	key       string
+	value     T
+	expiresAt time.Time
+}
+
+// newLRUCache returns an lruCache that holds at most maxItems entries,
+// evicting the least-recently-used one once full.
+func newLRUCache[T any](maxItems int) *lruCache[T] {
+	return &lruCache[T]{
+		maxItems: maxItems,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache[T]) Get(key string) (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero T
+	elem, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+	entry := elem.Value.(*lruCacheEntry[T])
+	if time.Now().After(entry.expiresAt) {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+		return zero, false
+	}
+
+	c.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *lruCache[T]) Set(key string, value T, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*lruCacheEntry[T]).value = value
+		elem.Value.(*lruCacheEntry[T]).expiresAt = time.Now().Add(ttl)
+		c.ll.MoveToFront(elem)
+		return
+	}
+
+	elem := c.ll.PushFront(&lruCacheEntry[T]{key: key, value: value, expiresAt: time.Now().Add(ttl)})
+	c.items[key] = elem
+
+	if c.ll.Len() > c.maxItems {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruCacheEntry[T]).key)
+		}
+	}
+}
+
+// lruAuthorizationCache is the default AuthorizationCache: a bounded,
+// in-memory, least-recently-used cache of authorization decisions.
+type lruAuthorizationCache struct {
+	cache *lruCache[bool]
+}
+
+// newLRUAuthorizationCache returns an AuthorizationCache that holds at most
+// maxItems decisions, evicting the least-recently-used entry once full.
+func newLRUAuthorizationCache(maxItems int) *lruAuthorizationCache {
+	return &lruAuthorizationCache{cache: newLRUCache[bool](maxItems)}
+}
+
+func (c *lruAuthorizationCache) Get(key string) (bool, bool) {
+	return c.cache.Get(key)
+}
+
+func (c *lruAuthorizationCache) Set(key string, decision bool, ttl time.Duration) {
+	c.cache.Set(key, decision, ttl)
+}
+
+// authzCacheKey builds the sha256 cache key for a (provider, subject,
+// variables) authorization decision. variables are included sorted by name
+// so the key is stable regardless of map iteration order.
+func authzCacheKey(providerName, subject string, variables map[string]string) string {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	h.Write([]byte(providerName))
+	h.Write([]byte("|"))
+	h.Write([]byte(subject))
+	for _, name := range names {
+		h.Write([]byte("|"))
+		h.Write([]byte(name))
+		h.Write([]byte("="))
+		h.Write([]byte(variables[name]))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
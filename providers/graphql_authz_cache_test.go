@@ -0,0 +1,50 @@
+package providers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUAuthorizationCacheGetSet(t *testing.T) {
+	cache := newLRUAuthorizationCache(2)
+
+	if _, ok := cache.Get("missing"); ok {
+		t.Fatal("Get on an empty cache should miss")
+	}
+
+	cache.Set("a", true, time.Minute)
+	decision, ok := cache.Get("a")
+	if !ok || !decision {
+		t.Fatalf("Get(%q) = (%v, %v), want (true, true)", "a", decision, ok)
+	}
+}
+
+func TestLRUAuthorizationCacheExpiry(t *testing.T) {
+	cache := newLRUAuthorizationCache(2)
+
+	cache.Set("a", true, -time.Second)
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("expected an already-expired entry to miss")
+	}
+}
+
+func TestLRUAuthorizationCacheEviction(t *testing.T) {
+	cache := newLRUAuthorizationCache(2)
+
+	cache.Set("a", true, time.Minute)
+	cache.Set("b", true, time.Minute)
+	// Touch "a" so it's the most-recently-used entry.
+	cache.Get("a")
+	// "b" is now the least-recently-used entry and should be evicted.
+	cache.Set("c", true, time.Minute)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("expected the least-recently-used entry to be evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("expected the recently-used entry to survive eviction")
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Fatal("expected the newly-set entry to be present")
+	}
+}
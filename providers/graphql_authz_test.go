@@ -0,0 +1,71 @@
+package providers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONPointer(t *testing.T) {
+	data := map[string]interface{}{
+		"environmentByRoute": map[string]interface{}{
+			"name": "main",
+			"project": map[string]interface{}{
+				"groups": []interface{}{
+					map[string]interface{}{"name": "owners"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		pointer string
+		want    interface{}
+	}{
+		{"", data},
+		{"/environmentByRoute/name", "main"},
+		{"/environmentByRoute/project/groups/0/name", "owners"},
+		{"/environmentByRoute/missing", nil},
+	}
+
+	for _, tt := range tests {
+		got, err := jsonPointer(data, tt.pointer)
+		if err != nil {
+			t.Fatalf("jsonPointer(%q) returned error: %v", tt.pointer, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("jsonPointer(%q) = %v, want %v", tt.pointer, got, tt.want)
+		}
+	}
+}
+
+func TestJSONPointerInvalidArrayIndex(t *testing.T) {
+	data := map[string]interface{}{"items": []interface{}{"a"}}
+	if _, err := jsonPointer(data, "/items/not-a-number"); err == nil {
+		t.Fatal("expected an error for a non-numeric array index")
+	}
+}
+
+func TestTruthy(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  bool
+	}{
+		{nil, false},
+		{true, true},
+		{false, false},
+		{"", false},
+		{"x", true},
+		{float64(0), false},
+		{float64(1), true},
+		{[]interface{}{}, false},
+		{[]interface{}{"x"}, true},
+		{map[string]interface{}{}, false},
+		{map[string]interface{}{"k": "v"}, true},
+	}
+
+	for _, tt := range tests {
+		if got := truthy(tt.value); got != tt.want {
+			t.Errorf("truthy(%#v) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
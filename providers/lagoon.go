@@ -1,123 +1,285 @@
 package providers
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"strings"
-	"encoding/base64"
 
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
-	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
 )
 
 const lagoonOIDCProviderName = "Lagoon OIDC"
 
 const lagoonGraphqlEndpoint = "http://lagoon-api.172.18.0.240.nip.io/graphql"
 
-const queryGetEnvironmentByRoute = `
+const lagoonQueryGetEnvironmentByRoute = `
 query GetEnvironmentByRoute($route: String!) {
   environmentByRoute(route: $route) {
     id
     name
+    openshiftProjectName
+    project {
+      groups {
+        name
+      }
+    }
+  }
+  me {
+    groupRoles {
+      group {
+        name
+      }
+      role
+    }
   }
 }
 `
-type environmentByRouteResponse struct {
-    Data struct {
-        EnvironmentByRoute struct {
-            ID   int `json:"id"`
-            Name string `json:"name"`
-        } `json:"environmentByRoute"`
-    } `json:"data"`
-    Errors []struct {
-        Message string `json:"message"`
-    } `json:"errors,omitempty"`
-}
 
+// Defaults for provider.lagoon.required_roles / required_groups: the Lagoon
+// roles that are allowed to access an environment. required_groups is empty
+// by default, meaning any group the environment belongs to is eligible as
+// long as the subject holds one of requiredRoles on it.
+var lagoonDefaultRequiredRoles = []string{"developer", "maintainer", "owner"}
+
+// LagoonOIDCProvider is a GraphQLAuthzProvider preset for Lagoon's
+// environmentByRoute API: authorization succeeds if the route resolves to a
+// named environment and the subject holds one of the required roles on one
+// of that environment's groups (see lagoonDecide).
 type LagoonOIDCProvider struct {
 	*OIDCProvider
+
+	authz  *GraphQLAuthzProvider
+	logout *rpInitiatedLogout
+	claims *lagoonClaimsVerifier
 }
 
 var _ Provider = (*LagoonOIDCProvider)(nil)
+var _ RPInitiatedSignOuter = (*LagoonOIDCProvider)(nil)
 
 func NewLagoonOIDCProvider(p *ProviderData, opts options.Provider) (*LagoonOIDCProvider, error) {
 	p.setProviderDefaults(providerDefaults{
 		name: lagoonOIDCProviderName,
 	})
 
+	oidcProvider := NewOIDCProvider(p, opts.OIDCConfig)
+
+	endpoint, query, variables, resultPointer := lagoonGraphQLOptions(opts.LagoonConfig)
+
 	provider := &LagoonOIDCProvider{
-		OIDCProvider: NewOIDCProvider(p, opts.OIDCConfig),
+		OIDCProvider: oidcProvider,
+		claims:       newLagoonClaimsVerifier(context.Background(), oidcProvider.Verifier, opts.OIDCConfig.IssuerURL, opts.OIDCConfig.LogTokenClaims),
+		authz: NewGraphQLAuthzProvider(GraphQLAuthzConfig{
+			Name:             "lagoon",
+			Endpoint:         endpoint,
+			Query:            query,
+			Variables:        variables,
+			ResultPointer:    resultPointer,
+			CacheTTL:         opts.LagoonConfig.AuthzCacheTTL,
+			CacheNegativeTTL: opts.LagoonConfig.AuthzCacheNegativeTTL,
+			Decide:           lagoonDecide(lagoonRequiredRoles(opts.LagoonConfig), opts.LagoonConfig.RequiredGroups),
+		}),
+		logout: newRPInitiatedLogout(RPInitiatedLogoutConfig{
+			Enabled:               opts.OIDCConfig.RPInitiatedLogout,
+			DiscoveryURL:          strings.TrimRight(opts.OIDCConfig.IssuerURL, "/") + "/.well-known/openid-configuration",
+			PostLogoutRedirectURI: opts.OIDCConfig.PostLogoutRedirectURL,
+		}),
 	}
 
 	return provider, nil
 }
 
-func (p *LagoonOIDCProvider) Authorize(ctx context.Context, s *sessions.SessionState) (bool, error) {
-	logger.Printf("Checking Lagoon provider for authorization on %s\n", s.AppRedirect)
-
-	parts := strings.Split(s.AccessToken, ".")
-    if len(parts) == 3 {
-		header, _ := base64.RawURLEncoding.DecodeString(parts[0])
-		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
-		logger.Printf("Access Token Header: %s\n", header)
-		logger.Printf("Access Token Payload: %s\n", payload)
-    }
+// lagoonGraphQLOptions resolves the GraphQL endpoint, query, variables and
+// result pointer for a LagoonOIDCProvider, falling back to the built-in
+// environmentByRoute defaults for anything operators leave unset via
+// provider.lagoon.graphql.*. Note that Decide, not ResultPointer, is what
+// actually governs Lagoon's default authorization decision below;
+// ResultPointer is only consulted if a future preset clears Decide.
+func lagoonGraphQLOptions(cfg options.LagoonOptions) (endpoint, query string, variables map[string]string, resultPointer string) {
+	endpoint = lagoonGraphqlEndpoint
+	if cfg.GraphQLEndpoint != "" {
+		endpoint = cfg.GraphQLEndpoint
+	}
 
-	route := strings.TrimRight(s.AppRedirect, "/")
-	if route == "" {
-		return false, fmt.Errorf("missing redirect URL")
+	query = lagoonQueryGetEnvironmentByRoute
+	if cfg.GraphQLQuery != "" {
+		query = cfg.GraphQLQuery
 	}
 
-	body := map[string]interface{}{
-		"query":    queryGetEnvironmentByRoute,
-		"variables": map[string]string{"route": route},
+	variables = map[string]string{"route": "{{.AppRedirect}}"}
+	if len(cfg.GraphQLVariables) > 0 {
+		variables = cfg.GraphQLVariables
 	}
-	bodyJSON, err := json.Marshal(body)
-	if err != nil {
-		return false, fmt.Errorf("failed to marshal GraphQL request: %w", err)
+
+	return endpoint, query, variables, cfg.ResultPointer
+}
+
+// lagoonRequiredRoles resolves provider.lagoon.required_roles, falling back
+// to lagoonDefaultRequiredRoles when operators don't set it.
+func lagoonRequiredRoles(cfg options.LagoonOptions) []string {
+	if len(cfg.RequiredRoles) > 0 {
+		return cfg.RequiredRoles
 	}
+	return lagoonDefaultRequiredRoles
+}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", lagoonGraphqlEndpoint, bytes.NewReader(bodyJSON))
+func (p *LagoonOIDCProvider) Authorize(ctx context.Context, s *sessions.SessionState) (bool, error) {
+	claims, err := p.claims.Verify(ctx, s.AccessToken)
 	if err != nil {
-		return false, fmt.Errorf("failed to create GraphQL request: %w", err)
+		return false, fmt.Errorf("Lagoon authorization denied: %w", err)
 	}
+	mergeLagoonClaims(s, claims)
 
-	req.Header.Set("Authorization", "Bearer " + s.AccessToken)
-	req.Header.Set("Content-Type", "application/json")
+	return p.authz.Authorize(ctx, s)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return false, fmt.Errorf("failed to call Lagoon GraphQL API: %w", err)
+// mergeLagoonClaims copies verified claims onto the session: Email and
+// PreferredUsername are authoritative fields already on SessionState, while
+// the realm roles, Lagoon-specific role and token audience have no
+// dedicated field and are merged into Groups (prefixed, since they share
+// that namespace with Lagoon's own group names) so --allowed-group rules
+// can match on them too.
+func mergeLagoonClaims(s *sessions.SessionState, claims *LagoonClaims) {
+	if claims.Email != "" {
+		s.Email = claims.Email
+	}
+	if claims.PreferredUsername != "" {
+		s.PreferredUsername = claims.PreferredUsername
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("unexpected GraphQL status: %d", resp.StatusCode)
+	var roleGroups []string
+	for _, role := range claims.RealmRoles {
+		roleGroups = append(roleGroups, "realm:"+role)
 	}
+	if claims.LagoonRole != "" {
+		roleGroups = append(roleGroups, "lagoon-role:"+claims.LagoonRole)
+	}
+	for _, aud := range claims.Audience {
+		roleGroups = append(roleGroups, "aud:"+aud)
+	}
+	mergeGroups(s, roleGroups)
+}
+
+// lagoonDecide builds a GraphQLAuthzConfig.Decide function that grants
+// access only if the session's subject holds one of requiredRoles on a
+// group associated with the resolved environment. When requiredGroups is
+// non-empty, the environment's groups are additionally filtered down to
+// that allowlist before role-checking. The matched groups are returned so
+// GraphQLAuthzProvider can merge them into s.Groups itself - including on a
+// cached decision, when this function doesn't run at all - so existing
+// X-Forwarded-Groups headers and --allowed-group rules keep working.
+func lagoonDecide(requiredRoles, requiredGroups []string) func(map[string]interface{}, *sessions.SessionState) (bool, []string, error) {
+	allowedRoles := make(map[string]bool, len(requiredRoles))
+	for _, role := range requiredRoles {
+		allowedRoles[role] = true
+	}
+	allowedGroups := make(map[string]bool, len(requiredGroups))
+	for _, group := range requiredGroups {
+		allowedGroups[group] = true
+	}
+
+	return func(data map[string]interface{}, s *sessions.SessionState) (bool, []string, error) {
+		envName, _ := jsonPointer(data, "/environmentByRoute/name")
+		if !truthy(envName) {
+			return false, nil, nil
+		}
+
+		envGroups := lagoonStringSet(data, "/environmentByRoute/project/groups", "name")
+		userRoles := lagoonGroupRoles(data)
 
-	defer resp.Body.Close()
+		var matched []string
+		for group := range envGroups {
+			if len(allowedGroups) > 0 && !allowedGroups[group] {
+				continue
+			}
+			if role, ok := userRoles[group]; ok && allowedRoles[role] {
+				matched = append(matched, group)
+			}
+		}
 
-	bodyBytes, _ := io.ReadAll(resp.Body)
-	logger.Printf("Lagoon Authorization returned:\n%s\n", string(bodyBytes))
+		if len(matched) == 0 {
+			return false, nil, nil
+		}
 
-	var gqlResp environmentByRouteResponse
-	if err := json.Unmarshal(bodyBytes, &gqlResp); err != nil {
-		return false, fmt.Errorf("failed to decode GraphQL response: %w", err)
+		return true, matched, nil
 	}
+}
 
-	if len(gqlResp.Errors) > 0 {
-		return false, fmt.Errorf("GraphQL error: %s", gqlResp.Errors[0].Message)
+// lagoonStringSet collects the string value of field from each element of
+// the array found at pointer, e.g. the set of group names.
+func lagoonStringSet(data map[string]interface{}, pointer, field string) map[string]bool {
+	set := make(map[string]bool)
+	value, err := jsonPointer(data, pointer)
+	if err != nil {
+		return set
 	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return set
+	}
+	for _, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if name, ok := obj[field].(string); ok {
+			set[name] = true
+		}
+	}
+	return set
+}
 
-	if gqlResp.Data.EnvironmentByRoute.Name != "" {
-		return true, nil
+// lagoonGroupRoles returns the subject's role (developer/maintainer/owner)
+// per group name, from me.groupRoles in the GraphQL response.
+func lagoonGroupRoles(data map[string]interface{}) map[string]string {
+	roles := make(map[string]string)
+	value, err := jsonPointer(data, "/me/groupRoles")
+	if err != nil {
+		return roles
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return roles
 	}
+	for _, item := range items {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		group, _ := jsonPointer(entry, "/group/name")
+		groupName, ok := group.(string)
+		if !ok {
+			continue
+		}
+		role, _ := entry["role"].(string)
+		roles[groupName] = role
+	}
+	return roles
+}
 
-	return false, nil
+// mergeGroups appends any of groups not already present in s.Groups.
+func mergeGroups(s *sessions.SessionState, groups []string) {
+	existing := make(map[string]bool, len(s.Groups))
+	for _, g := range s.Groups {
+		existing[g] = true
+	}
+	for _, g := range groups {
+		if !existing[g] {
+			s.Groups = append(s.Groups, g)
+			existing[g] = true
+		}
+	}
 }
 
+// SignOut returns the Lagoon IdP's end_session_endpoint redirect for s, and
+// the state cookie that must be set on the response alongside it, so callers
+// can additionally send the browser there (RP-initiated logout) when
+// provider.oidc.rp_initiated_logout is enabled. An empty string (with a nil
+// cookie and error) means logout is disabled, the IdP doesn't support it, or
+// s has no ID token to hint with; callers should fall back to clearing the
+// local session only. The eventual post_logout_redirect_uri callback should
+// check its "state" parameter with VerifyLogoutState before trusting it.
+func (p *LagoonOIDCProvider) SignOut(ctx context.Context, s *sessions.SessionState) (string, *http.Cookie, error) {
+	return p.logout.SignOutURL(ctx, s)
+}
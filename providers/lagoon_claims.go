@@ -0,0 +1,131 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// lagoonFallbackVerifierRetryInterval bounds how often a failed fallback
+// verifier discovery (see ensureFallback) is retried, so a persistently
+// unreachable issuer doesn't turn every Verify call into a discovery attempt.
+const lagoonFallbackVerifierRetryInterval = time.Minute
+
+// LagoonClaims holds the claims this provider needs out of a verified
+// Lagoon access token.
+type LagoonClaims struct {
+	PreferredUsername string
+	Email             string
+	RealmRoles        []string
+	LagoonRole        string
+	Audience          []string
+}
+
+// lagoonClaimsVerifier verifies a Lagoon access token's signature before any
+// of its claims are trusted. It tries the parent OIDCProvider's verifier
+// first (works when the access token shares the ID token's audience), and
+// falls back to a dedicated verifier built from the issuer's own JWKS
+// (SkipClientIDCheck, since access tokens are typically minted for a
+// different audience than the OAuth2 client).
+type lagoonClaimsVerifier struct {
+	primary *oidc.IDTokenVerifier
+
+	issuerURL      string
+	logTokenClaims bool
+
+	mu          sync.Mutex
+	fallback    *oidc.IDTokenVerifier
+	lastAttempt time.Time
+}
+
+// newLagoonClaimsVerifier builds a lagoonClaimsVerifier for issuerURL.
+// logTokenClaims gates the debug-only claim-name log in Verify and comes
+// from the --log-token-claims flag. Fallback verifier discovery is attempted
+// once here; JWKS fetch/refresh happens lazily and is cached by the
+// underlying go-oidc key set. A discovery failure here is logged, not fatal - primary
+// alone may still be able to verify tokens - and is retried lazily from
+// Verify rather than only once at construction time.
+func newLagoonClaimsVerifier(ctx context.Context, primary *oidc.IDTokenVerifier, issuerURL string, logTokenClaims bool) *lagoonClaimsVerifier {
+	v := &lagoonClaimsVerifier{primary: primary, issuerURL: issuerURL, logTokenClaims: logTokenClaims}
+	v.ensureFallback(ctx)
+	return v
+}
+
+// ensureFallback returns the fallback verifier, attempting (or retrying)
+// discovery against issuerURL if it isn't set yet. Retries are throttled to
+// lagoonFallbackVerifierRetryInterval so a down/unreachable issuer doesn't
+// turn every Verify call into a fresh discovery round-trip.
+func (v *lagoonClaimsVerifier) ensureFallback(ctx context.Context) *oidc.IDTokenVerifier {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.fallback != nil {
+		return v.fallback
+	}
+	if !v.lastAttempt.IsZero() && time.Since(v.lastAttempt) < lagoonFallbackVerifierRetryInterval {
+		return nil
+	}
+	v.lastAttempt = time.Now()
+
+	oidcProvider, err := oidc.NewProvider(ctx, v.issuerURL)
+	if err != nil {
+		logger.Printf("failed to initialize fallback Lagoon access-token verifier for %s: %v\n", v.issuerURL, err)
+		return nil
+	}
+	v.fallback = oidcProvider.Verifier(&oidc.Config{SkipClientIDCheck: true})
+	return v.fallback
+}
+
+// Verify checks rawAccessToken's signature and returns its Lagoon claims.
+// It fails closed: any verification or decode error is returned rather than
+// swallowed, and the raw token is never logged.
+func (v *lagoonClaimsVerifier) Verify(ctx context.Context, rawAccessToken string) (*LagoonClaims, error) {
+	idToken, err := v.verify(ctx, rawAccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify Lagoon access token: %w", err)
+	}
+
+	var raw struct {
+		PreferredUsername string `json:"preferred_username"`
+		Email             string `json:"email"`
+		RealmAccess       struct {
+			Roles []string `json:"roles"`
+		} `json:"realm_access"`
+		Lagoon struct {
+			Role string `json:"role"`
+		} `json:"lagoon"`
+	}
+	if err := idToken.Claims(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode verified Lagoon claims: %w", err)
+	}
+
+	if v.logTokenClaims {
+		logger.Printf("Lagoon access token claims verified: preferred_username, email, realm_access.roles, lagoon.role, aud\n")
+	}
+
+	return &LagoonClaims{
+		PreferredUsername: raw.PreferredUsername,
+		Email:             raw.Email,
+		RealmRoles:        raw.RealmAccess.Roles,
+		LagoonRole:        raw.Lagoon.Role,
+		Audience:          idToken.Audience,
+	}, nil
+}
+
+func (v *lagoonClaimsVerifier) verify(ctx context.Context, rawAccessToken string) (*oidc.IDToken, error) {
+	if v.primary != nil {
+		if idToken, err := v.primary.Verify(ctx, rawAccessToken); err == nil {
+			return idToken, nil
+		}
+	}
+	fallback := v.ensureFallback(ctx)
+	if fallback == nil {
+		return nil, fmt.Errorf("no verifier available for issuer")
+	}
+	return fallback.Verify(ctx, rawAccessToken)
+}
@@ -0,0 +1,41 @@
+package providers
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEnsureFallbackRetriesAfterInterval(t *testing.T) {
+	v := &lagoonClaimsVerifier{issuerURL: "http://127.0.0.1:0/issuer-that-does-not-exist"}
+
+	if fallback := v.ensureFallback(context.Background()); fallback != nil {
+		t.Fatal("expected the first discovery attempt against an unreachable issuer to fail")
+	}
+	firstAttempt := v.lastAttempt
+	if firstAttempt.IsZero() {
+		t.Fatal("expected lastAttempt to be recorded after a discovery attempt")
+	}
+
+	if fallback := v.ensureFallback(context.Background()); fallback != nil {
+		t.Fatal("expected a retry within lagoonFallbackVerifierRetryInterval to be skipped")
+	}
+	if v.lastAttempt != firstAttempt {
+		t.Fatal("expected a throttled retry to not update lastAttempt")
+	}
+
+	v.lastAttempt = time.Now().Add(-lagoonFallbackVerifierRetryInterval - time.Second)
+	staleAttempt := v.lastAttempt
+	v.ensureFallback(context.Background())
+	if v.lastAttempt == staleAttempt {
+		t.Fatal("expected a retry past lagoonFallbackVerifierRetryInterval to attempt discovery again")
+	}
+}
+
+func TestVerifyFailsClosedWithNoVerifierAvailable(t *testing.T) {
+	v := &lagoonClaimsVerifier{issuerURL: "http://127.0.0.1:0/issuer-that-does-not-exist"}
+
+	if _, err := v.verify(context.Background(), "token"); err == nil {
+		t.Fatal("expected verify to fail closed with no primary and an unresolvable fallback")
+	}
+}
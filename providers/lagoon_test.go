@@ -0,0 +1,149 @@
+package providers
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+func lagoonEnvironmentData(envName string, groupRoles map[string]string, projectGroups []string) map[string]interface{} {
+	groups := make([]interface{}, 0, len(projectGroups))
+	for _, g := range projectGroups {
+		groups = append(groups, map[string]interface{}{"name": g})
+	}
+
+	roles := make([]interface{}, 0, len(groupRoles))
+	for group, role := range groupRoles {
+		roles = append(roles, map[string]interface{}{
+			"group": map[string]interface{}{"name": group},
+			"role":  role,
+		})
+	}
+
+	return map[string]interface{}{
+		"environmentByRoute": map[string]interface{}{
+			"name": envName,
+			"project": map[string]interface{}{
+				"groups": groups,
+			},
+		},
+		"me": map[string]interface{}{
+			"groupRoles": roles,
+		},
+	}
+}
+
+func TestLagoonDecideGrantsOnMatchingRole(t *testing.T) {
+	decide := lagoonDecide([]string{"developer", "maintainer"}, nil)
+	data := lagoonEnvironmentData("main", map[string]string{"acme": "developer"}, []string{"acme"})
+
+	decision, groups, err := decide(data, &sessions.SessionState{})
+	if err != nil {
+		t.Fatalf("lagoonDecide returned an error: %v", err)
+	}
+	if !decision {
+		t.Fatal("expected access to be granted for a matching role")
+	}
+	if !reflect.DeepEqual(groups, []string{"acme"}) {
+		t.Fatalf("groups = %v, want [acme]", groups)
+	}
+}
+
+func TestLagoonDecideDeniesWithoutRequiredRole(t *testing.T) {
+	decide := lagoonDecide([]string{"maintainer", "owner"}, nil)
+	data := lagoonEnvironmentData("main", map[string]string{"acme": "developer"}, []string{"acme"})
+
+	decision, groups, err := decide(data, &sessions.SessionState{})
+	if err != nil {
+		t.Fatalf("lagoonDecide returned an error: %v", err)
+	}
+	if decision {
+		t.Fatal("expected access to be denied without a required role")
+	}
+	if len(groups) != 0 {
+		t.Fatalf("groups = %v, want none", groups)
+	}
+}
+
+func TestLagoonDecideFiltersToRequiredGroups(t *testing.T) {
+	decide := lagoonDecide([]string{"developer"}, []string{"other-project"})
+	data := lagoonEnvironmentData("main", map[string]string{"acme": "developer"}, []string{"acme"})
+
+	decision, _, err := decide(data, &sessions.SessionState{})
+	if err != nil {
+		t.Fatalf("lagoonDecide returned an error: %v", err)
+	}
+	if decision {
+		t.Fatal("expected access to be denied when the matching group isn't in required_groups")
+	}
+}
+
+func TestLagoonDecideDeniesWhenEnvironmentNotFound(t *testing.T) {
+	decide := lagoonDecide([]string{"developer"}, nil)
+	data := map[string]interface{}{"environmentByRoute": nil}
+
+	decision, groups, err := decide(data, &sessions.SessionState{})
+	if err != nil {
+		t.Fatalf("lagoonDecide returned an error: %v", err)
+	}
+	if decision || len(groups) != 0 {
+		t.Fatal("expected no decision or groups when the environment doesn't resolve")
+	}
+}
+
+func TestMergeLagoonClaimsMergesAudienceIntoGroups(t *testing.T) {
+	s := &sessions.SessionState{}
+	mergeLagoonClaims(s, &LagoonClaims{
+		RealmRoles: []string{"offline_access"},
+		LagoonRole: "developer",
+		Audience:   []string{"lagoon-api", "other-client"},
+	})
+
+	sort.Strings(s.Groups)
+	want := []string{"aud:lagoon-api", "aud:other-client", "lagoon-role:developer", "realm:offline_access"}
+	if !reflect.DeepEqual(s.Groups, want) {
+		t.Fatalf("s.Groups = %v, want %v", s.Groups, want)
+	}
+}
+
+// TestGraphQLAuthzProviderReplaysGroupsOnCacheHit guards against the
+// decision cache and the Decide-attributed groups drifting apart: a cached
+// "true" decision must keep merging the same groups onto s.Groups it merged
+// on the original (fresh) call, not just on the call that actually ran
+// Decide.
+func TestGraphQLAuthzProviderReplaysGroupsOnCacheHit(t *testing.T) {
+	calls := 0
+	p := NewGraphQLAuthzProvider(GraphQLAuthzConfig{
+		Name:      "test",
+		Endpoint:  "http://example.invalid/graphql",
+		Query:     "query {}",
+		Variables: map[string]string{"route": "{{.AppRedirect}}"},
+		Decide: func(map[string]interface{}, *sessions.SessionState) (bool, []string, error) {
+			calls++
+			return true, []string{"acme"}, nil
+		},
+	})
+
+	key := authzCacheKey("test", "user", map[string]string{"route": "https://example.com"})
+	p.cache.Set(key, true, defaultAuthzCacheTTL)
+	p.groupsCache.Set(key, []string{"acme"}, defaultAuthzCacheTTL)
+
+	s := &sessions.SessionState{User: "user", AppRedirect: "https://example.com"}
+	decision, err := p.Authorize(nil, s) //nolint:staticcheck // nil context is fine: the cache hit path never touches it
+	if err != nil {
+		t.Fatalf("Authorize returned an error: %v", err)
+	}
+	if !decision {
+		t.Fatal("expected the cached decision to grant access")
+	}
+	if calls != 0 {
+		t.Fatal("Decide should not run again on a cache hit")
+	}
+
+	sort.Strings(s.Groups)
+	if !reflect.DeepEqual(s.Groups, []string{"acme"}) {
+		t.Fatalf("s.Groups = %v, want [acme] replayed from the cache", s.Groups)
+	}
+}
@@ -0,0 +1,217 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/logger"
+)
+
+// rpInitiatedLogoutDiscovery is the subset of an OIDC discovery document
+// (".well-known/openid-configuration") this package cares about.
+type rpInitiatedLogoutDiscovery struct {
+	EndSessionEndpoint string `json:"end_session_endpoint"`
+}
+
+// RPInitiatedLogoutConfig configures RP-initiated logout (OpenID Connect
+// Session Management) for an OIDCProvider: redirecting the user's browser to
+// the identity provider's end_session_endpoint so they're signed out there
+// too, not just locally.
+type RPInitiatedLogoutConfig struct {
+	// Enabled gates RP-initiated logout behind provider.oidc.rp_initiated_logout;
+	// SignOutURL is a no-op when false, since redirecting a user's browser to
+	// another origin on sign-out isn't safe to turn on unconditionally.
+	Enabled bool
+	// DiscoveryURL is the issuer's ".well-known/openid-configuration"
+	// document, used to discover EndSessionURL when it isn't set directly.
+	DiscoveryURL string
+	// EndSessionURL overrides discovery when the IdP doesn't publish
+	// end_session_endpoint (or operators want to pin it).
+	EndSessionURL string
+	// PostLogoutRedirectURI is sent to the IdP as post_logout_redirect_uri.
+	PostLogoutRedirectURI string
+	HTTPClient            *http.Client
+}
+
+// rpInitiatedLogoutStateCookieName is the short-lived cookie SignOutURL asks
+// the caller to set, and VerifyLogoutState checks the returned state against.
+const rpInitiatedLogoutStateCookieName = "_oauth2_proxy_logout_state"
+
+// rpInitiatedLogoutStateCookieMaxAge bounds how long a logout redirect has to
+// complete before its state cookie expires.
+const rpInitiatedLogoutStateCookieMaxAge = 5 * time.Minute
+
+// rpInitiatedLogoutDiscoveryTimeout bounds a single discovery request, so a
+// stalled IdP can't hang a sign-out request indefinitely.
+const rpInitiatedLogoutDiscoveryTimeout = 5 * time.Second
+
+// rpInitiatedLogoutDiscoveryRetryInterval throttles re-attempting discovery
+// after a failed attempt, mirroring lagoonClaimsVerifier.ensureFallback: a
+// down/unreachable discovery endpoint shouldn't turn every sign-out request
+// into a fresh round-trip with no backoff.
+const rpInitiatedLogoutDiscoveryRetryInterval = time.Minute
+
+// rpInitiatedLogout resolves and builds end-session redirects for a single
+// OIDC provider instance. The end_session_endpoint is discovered once and
+// cached; a failed discovery attempt is retried lazily, throttled to
+// rpInitiatedLogoutDiscoveryRetryInterval.
+type rpInitiatedLogout struct {
+	cfg RPInitiatedLogoutConfig
+
+	mu            sync.Mutex
+	resolved      bool
+	endSessionURL string
+	lastAttempt   time.Time
+}
+
+// newRPInitiatedLogout builds an rpInitiatedLogout helper for cfg. It is
+// always safe to construct, even if the IdP turns out not to support
+// end_session_endpoint: callers fall back to local-only logout in that case.
+func newRPInitiatedLogout(cfg RPInitiatedLogoutConfig) *rpInitiatedLogout {
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: rpInitiatedLogoutDiscoveryTimeout}
+	}
+	if cfg.EndSessionURL != "" {
+		return &rpInitiatedLogout{cfg: cfg, resolved: true, endSessionURL: cfg.EndSessionURL}
+	}
+	return &rpInitiatedLogout{cfg: cfg}
+}
+
+// SignOutURL returns the end_session_endpoint redirect for s and the cookie
+// that must be set on the response alongside it, so the returned state can
+// later be checked with VerifyLogoutState instead of trusting it as a bare
+// query parameter. It returns ("", nil, nil) when RP-initiated logout is
+// disabled, unavailable (no end_session_endpoint), or s has no ID token to
+// hint with; callers should fall back to clearing the local session only.
+func (l *rpInitiatedLogout) SignOutURL(ctx context.Context, s *sessions.SessionState) (string, *http.Cookie, error) {
+	if !l.cfg.Enabled || s.IDToken == "" {
+		return "", nil, nil
+	}
+
+	endSessionURL, err := l.resolveEndSessionURL(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to discover end_session_endpoint: %w", err)
+	}
+	if endSessionURL == "" {
+		return "", nil, nil
+	}
+
+	u, err := url.Parse(endSessionURL)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid end_session_endpoint %q: %w", endSessionURL, err)
+	}
+
+	state, err := randomState()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate logout state: %w", err)
+	}
+
+	q := u.Query()
+	q.Set("id_token_hint", s.IDToken)
+	if l.cfg.PostLogoutRedirectURI != "" {
+		q.Set("post_logout_redirect_uri", l.cfg.PostLogoutRedirectURI)
+	}
+	q.Set("state", state)
+	u.RawQuery = q.Encode()
+
+	cookie := &http.Cookie{
+		Name:     rpInitiatedLogoutStateCookieName,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(rpInitiatedLogoutStateCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return u.String(), cookie, nil
+}
+
+// RPInitiatedSignOuter is implemented by providers (e.g. LagoonOIDCProvider)
+// that support RP-initiated logout, so an http.Handler can invoke it without
+// depending on a specific provider type. Call SignOut when handling
+// /oauth2/sign_out: if it returns a non-empty redirect, set the returned
+// cookie on the response and send the browser there instead of (or in
+// addition to) the handler's usual local-only redirect.
+type RPInitiatedSignOuter interface {
+	SignOut(ctx context.Context, s *sessions.SessionState) (redirect string, stateCookie *http.Cookie, err error)
+}
+
+// VerifyLogoutState reports whether state (typically the "state" query
+// parameter on a post_logout_redirect_uri callback) matches the value of the
+// cookie SignOutURL asked the caller to set. Callers should clear the cookie
+// once they're done with it regardless of the outcome.
+func VerifyLogoutState(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(rpInitiatedLogoutStateCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return cookie.Value == state
+}
+
+// resolveEndSessionURL returns the IdP's end_session_endpoint, discovering
+// and caching it from cfg.DiscoveryURL on first use. An empty result (with a
+// nil error) means the IdP doesn't advertise one, or a previous discovery
+// attempt failed and the retry throttle hasn't elapsed yet - both are
+// reported as "nothing to do" so SignOutURL falls back to local-only logout
+// instead of hanging or hammering a struggling IdP.
+func (l *rpInitiatedLogout) resolveEndSessionURL(ctx context.Context) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.resolved {
+		return l.endSessionURL, nil
+	}
+	if !l.lastAttempt.IsZero() && time.Since(l.lastAttempt) < rpInitiatedLogoutDiscoveryRetryInterval {
+		return "", nil
+	}
+	l.lastAttempt = time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.cfg.DiscoveryURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := l.cfg.HTTPClient.Do(req)
+	if err != nil {
+		logger.Printf("failed to fetch OIDC discovery document %s: %v; retrying in %s\n", l.cfg.DiscoveryURL, err, rpInitiatedLogoutDiscoveryRetryInterval)
+		return "", nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Printf("OIDC discovery returned %d fetching %s; continuing with local-only logout, retrying in %s\n", resp.StatusCode, l.cfg.DiscoveryURL, rpInitiatedLogoutDiscoveryRetryInterval)
+		return "", nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var doc rpInitiatedLogoutDiscovery
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return "", err
+	}
+
+	l.endSessionURL = doc.EndSessionEndpoint
+	l.resolved = true
+	return l.endSessionURL, nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
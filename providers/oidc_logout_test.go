@@ -0,0 +1,112 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/v7/pkg/apis/sessions"
+)
+
+func TestRPInitiatedLogoutDisabled(t *testing.T) {
+	l := newRPInitiatedLogout(RPInitiatedLogoutConfig{
+		EndSessionURL: "https://idp.example.com/logout",
+	})
+
+	redirect, cookie, err := l.SignOutURL(context.Background(), &sessions.SessionState{IDToken: "id-token"})
+	if err != nil {
+		t.Fatalf("SignOutURL returned an error: %v", err)
+	}
+	if redirect != "" || cookie != nil {
+		t.Fatalf("SignOutURL() = (%q, %v), want (\"\", nil) when Enabled is false", redirect, cookie)
+	}
+}
+
+func TestRPInitiatedLogoutNoIDToken(t *testing.T) {
+	l := newRPInitiatedLogout(RPInitiatedLogoutConfig{
+		Enabled:       true,
+		EndSessionURL: "https://idp.example.com/logout",
+	})
+
+	redirect, cookie, err := l.SignOutURL(context.Background(), &sessions.SessionState{})
+	if err != nil {
+		t.Fatalf("SignOutURL returned an error: %v", err)
+	}
+	if redirect != "" || cookie != nil {
+		t.Fatalf("SignOutURL() = (%q, %v), want (\"\", nil) with no ID token", redirect, cookie)
+	}
+}
+
+func TestRPInitiatedLogoutStateCookieVerifies(t *testing.T) {
+	l := newRPInitiatedLogout(RPInitiatedLogoutConfig{
+		Enabled:       true,
+		EndSessionURL: "https://idp.example.com/logout",
+	})
+
+	redirect, cookie, err := l.SignOutURL(context.Background(), &sessions.SessionState{IDToken: "id-token"})
+	if err != nil {
+		t.Fatalf("SignOutURL returned an error: %v", err)
+	}
+	if redirect == "" || cookie == nil {
+		t.Fatal("expected a redirect URL and state cookie when logout is enabled")
+	}
+
+	state := cookie.Value
+
+	req := httptest.NewRequest("GET", "/oauth2/logout-callback", nil)
+	req.AddCookie(cookie)
+	if !VerifyLogoutState(req, state) {
+		t.Fatal("VerifyLogoutState should match the state embedded in SignOutURL's cookie")
+	}
+	if VerifyLogoutState(req, "tampered-state") {
+		t.Fatal("VerifyLogoutState should reject a state that doesn't match the cookie")
+	}
+
+	reqNoCookie := httptest.NewRequest("GET", "/oauth2/logout-callback", nil)
+	if VerifyLogoutState(reqNoCookie, state) {
+		t.Fatal("VerifyLogoutState should reject a request with no state cookie")
+	}
+}
+
+func TestNewRPInitiatedLogoutDefaultsClientTimeout(t *testing.T) {
+	l := newRPInitiatedLogout(RPInitiatedLogoutConfig{Enabled: true, DiscoveryURL: "https://idp.example.com/.well-known/openid-configuration"})
+
+	if l.cfg.HTTPClient.Timeout != rpInitiatedLogoutDiscoveryTimeout {
+		t.Fatalf("default HTTPClient.Timeout = %s, want %s", l.cfg.HTTPClient.Timeout, rpInitiatedLogoutDiscoveryTimeout)
+	}
+}
+
+func TestResolveEndSessionURLThrottlesRetryAfterFailure(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	l := newRPInitiatedLogout(RPInitiatedLogoutConfig{Enabled: true, DiscoveryURL: server.URL})
+
+	if _, err := l.resolveEndSessionURL(context.Background()); err != nil {
+		t.Fatalf("resolveEndSessionURL returned an error: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected the first call to attempt discovery once, got %d requests", requests)
+	}
+
+	if _, err := l.resolveEndSessionURL(context.Background()); err != nil {
+		t.Fatalf("resolveEndSessionURL returned an error: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected a retry within rpInitiatedLogoutDiscoveryRetryInterval to be throttled, got %d requests", requests)
+	}
+
+	l.lastAttempt = time.Now().Add(-rpInitiatedLogoutDiscoveryRetryInterval - time.Second)
+	if _, err := l.resolveEndSessionURL(context.Background()); err != nil {
+		t.Fatalf("resolveEndSessionURL returned an error: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected a retry past rpInitiatedLogoutDiscoveryRetryInterval to attempt discovery again, got %d requests", requests)
+	}
+}